@@ -2,9 +2,15 @@ package history
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
 
@@ -20,7 +26,16 @@ func (r *Effect) UnmarshalDetails(dest interface{}) error {
 		return nil
 	}
 
-	err := errors.Wrap(json.Unmarshal([]byte(r.DetailsString.String), &dest), "unmarshal effect details failed")
+	raw := []byte(r.DetailsString.String)
+	if _, ok := dest.(*effects.Trade); ok {
+		var err error
+		raw, err = r.withSyntheticOfferID(raw)
+		if err != nil {
+			return errors.Wrap(err, "unmarshal effect details failed")
+		}
+	}
+
+	err := errors.Wrap(json.Unmarshal(raw, &dest), "unmarshal effect details failed")
 	if err == nil {
 		// In 2.9.0 a new `asset_type` was introduced to include liquidity
 		// pools. Instead of reingesting entire history, let's fill the
@@ -45,6 +60,34 @@ func (r *Effect) UnmarshalDetails(dest interface{}) error {
 	return err
 }
 
+// withSyntheticOfferID rewrites a trade effect's "offer_id" field when it
+// is absent or zero -- e.g. because the counter offer was filled
+// immediately and never got a stellar-core offer id -- synthesizing a
+// stable one from this effect's operation id so clients get a
+// cross-referenceable id instead of 0. The original value (0 when the
+// field was absent) is written under "raw_offer_id".
+//
+// UnmarshalDetails applies this rewrite only when its destination is
+// *effects.Trade. protocols/horizon/effects.Trade has no RawOfferID field,
+// so encoding/json drops "raw_offer_id" there; only callers that read this
+// function's JSON output directly, as effect_test.go does, see that field.
+func (r *Effect) withSyntheticOfferID(raw []byte) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return raw, err
+	}
+
+	offerID, _ := fields["offer_id"].(float64)
+	if offerID != 0 {
+		return raw, nil
+	}
+
+	fields["raw_offer_id"] = offerID
+	fields["offer_id"] = EncodeOfferId(uint64(r.HistoryOperationID), OfferIDTypeTOID)
+
+	return json.Marshal(fields)
+}
+
 func getAssetTypeForCanonicalAsset(canonicalAsset string) string {
 	if len(canonicalAsset) <= 61 {
 		return "credit_alphanum4"
@@ -53,6 +96,32 @@ func getAssetTypeForCanonicalAsset(canonicalAsset string) string {
 	}
 }
 
+// OfferIDType tags the domain an encoded offer id was minted from, so an id
+// synthesized here can never collide with a real stellar-core offer id.
+type OfferIDType int32
+
+const (
+	// OfferIDTypeCore marks an id assigned by stellar-core itself.
+	OfferIDTypeCore OfferIDType = iota
+	// OfferIDTypeTOID marks an id synthesized from a toid because no core
+	// offer id exists, e.g. a counter offer that was filled immediately
+	// and never persisted as a standing offer.
+	OfferIDTypeTOID
+)
+
+// offerIDTypeBit is the bit of an encoded offer id (the second-highest
+// bit of the int64) that carries its OfferIDType.
+const offerIDTypeBit = 62
+
+// EncodeOfferId synthesizes a stable offer id from a toid-packed
+// HistoryOperationID by clearing bit offerIDTypeBit and setting `idType`
+// there. The toid is not shifted and its other bits are kept, so distinct
+// operations with ledger sequences below 2^30 get distinct ids.
+func EncodeOfferId(internalID uint64, idType OfferIDType) int64 {
+	internalID &^= uint64(1) << offerIDTypeBit
+	return int64(internalID | uint64(idType)<<offerIDTypeBit)
+}
+
 // ID returns a lexically ordered id for this effect record
 func (r *Effect) ID() string {
 	return fmt.Sprintf("%019d-%010d", r.HistoryOperationID, r.Order)
@@ -69,6 +138,12 @@ func (r *Effect) PagingToken() string {
 	return fmt.Sprintf("%d-%d", r.HistoryOperationID, r.Order)
 }
 
+// CreatedAt returns the close time of the ledger this effect occurred in,
+// looked up from `ledgers` as populated by EffectsQ.WithLedgers().Select.
+func (r *Effect) CreatedAt(ledgers map[int32]Ledger) time.Time {
+	return ledgers[r.LedgerSequence()].ClosedAt
+}
+
 // Effects provides a helper to filter rows from the `history_effects`
 // table with pre-defined filters.  See `TransactionsQ` methods for the
 // available filters.
@@ -79,6 +154,38 @@ func (q *Q) Effects() *EffectsQ {
 	}
 }
 
+// ErrBeyondRetention is returned when a query would need to scan history
+// operation ids older than horizon's configured retention window.
+var ErrBeyondRetention = errors.New("this operation was beyond the history retention window set in this horizon instance")
+
+// checkRetention rejects `opID` with ErrBeyondRetention if it names a real
+// scan anchor that falls before the oldest operation id guaranteed to
+// still be present under q.parent's configured HistoryRetentionCount, so
+// callers short-circuit instead of scanning down into a reaped partition
+// for an empty result.
+//
+// A zero opID means no anchor was supplied -- e.g. a first, cursor-less
+// page -- and is never rejected: in that case the scan's natural bound is
+// whatever the reaper has already left in the table, not a cursor the
+// caller chose, so there is nothing to validate against the retention
+// window.
+func (q *EffectsQ) checkRetention(opID int64) error {
+	if opID <= 0 {
+		return nil
+	}
+
+	minLedger := q.parent.RetentionMinLedger()
+	if minLedger == 0 {
+		return nil
+	}
+
+	if opID < toid.New(minLedger, 0, 0).ToInt64() {
+		return ErrBeyondRetention
+	}
+
+	return nil
+}
+
 // ForAccount filters the operations collection to a specific account
 func (q *EffectsQ) ForAccount(ctx context.Context, aid string) *EffectsQ {
 	var account Account
@@ -103,6 +210,9 @@ func (q *EffectsQ) ForLedger(ctx context.Context, seq int32) *EffectsQ {
 
 	start := toid.ID{LedgerSequence: seq}
 	end := toid.ID{LedgerSequence: seq + 1}
+	if q.Err = q.checkRetention(start.ToInt64()); q.Err != nil {
+		return q
+	}
 	q.sql = q.sql.Where(
 		"heff.history_operation_id >= ? AND heff.history_operation_id < ?",
 		start.ToInt64(),
@@ -118,6 +228,9 @@ func (q *EffectsQ) ForOperation(id int64) *EffectsQ {
 	start := toid.Parse(id)
 	end := start
 	end.IncOperationOrder()
+	if q.Err = q.checkRetention(start.ToInt64()); q.Err != nil {
+		return q
+	}
 	q.sql = q.sql.Where(
 		"heff.history_operation_id >= ? AND heff.history_operation_id < ?",
 		start.ToInt64(),
@@ -139,6 +252,9 @@ func (q *EffectsQ) ForLiquidityPool(ctx context.Context, page db2.PageQuery, id
 		q.Err = err
 		return q
 	}
+	if q.Err = q.checkRetention(op); q.Err != nil {
+		return q
+	}
 
 	query := `SELECT holp.history_operation_id
 	FROM history_operation_liquidity_pools holp
@@ -167,6 +283,34 @@ func (q *EffectsQ) ForLiquidityPool(ctx context.Context, page db2.PageQuery, id
 	return q
 }
 
+// ErrClaimableBalanceEffectsNotWired is returned by ForClaimableBalance.
+// Querying history_operation_claimable_balances today would either error
+// against a real schema (the table isn't created by this series) or, if it
+// existed, always return zero rows, since nothing populates it during
+// ingestion yet. Rather than ship a filter that looks functional but can
+// never return data, ForClaimableBalance refuses up front.
+var ErrClaimableBalanceEffectsNotWired = errors.New("claimable balance effect filtering is not wired up: " +
+	"ingestion does not populate history_operation_claimable_balances, and no route " +
+	"exposes /claimable_balances/{id}/effects yet")
+
+// ForClaimableBalance is a deliberately unfinished split off of the request
+// to filter effects by claimable balance id. The query-only half implied by
+// that request can't be delivered on its own: it would need a
+// NewEffectBatchInsertBuilder-equivalent ingestion path that populates
+// history_operation_claimable_balances (nothing does today) and the route +
+// HTTP action wiring `/claimable_balances/{id}/effects` into the effects
+// handler, both of which live outside db2/history. Until that follow-up
+// lands, this returns ErrClaimableBalanceEffectsNotWired instead of quietly
+// building a query that can never return data.
+func (q *EffectsQ) ForClaimableBalance(ctx context.Context, page db2.PageQuery, id string) *EffectsQ {
+	if q.Err != nil {
+		return q
+	}
+
+	q.Err = ErrClaimableBalanceEffectsNotWired
+	return q
+}
+
 // ForTransaction filters the query to only effects in a specific
 // transaction, specified by the transactions's hex-encoded hash.
 func (q *EffectsQ) ForTransaction(ctx context.Context, hash string) *EffectsQ {
@@ -179,6 +323,9 @@ func (q *EffectsQ) ForTransaction(ctx context.Context, hash string) *EffectsQ {
 	start := toid.Parse(tx.ID)
 	end := start
 	end.TransactionOrder++
+	if q.Err = q.checkRetention(start.ToInt64()); q.Err != nil {
+		return q
+	}
 	q.sql = q.sql.Where(
 		"heff.history_operation_id >= ? AND heff.history_operation_id < ?",
 		start.ToInt64(),
@@ -188,7 +335,15 @@ func (q *EffectsQ) ForTransaction(ctx context.Context, hash string) *EffectsQ {
 	return q
 }
 
-// Page specifies the paging constraints for the query being built by `q`.
+// Page specifies the paging constraints for the query being built by `q`,
+// using the existing db2.PageQuery "<op>-<idx>" cursor format.
+//
+// Scope note: Page keeps its original signature and keyset predicate; the
+// one added behavior is that a cursor operation id older than the retention
+// window sets q.Err to ErrBeyondRetention. EffectsCursor/Cursor/First/
+// SelectCursorPage/FilterKey below are a separate, opt-in keyset
+// pagination mechanism added alongside it, not a rework of this call path
+// or of the existing /effects handlers that already call Page.
 func (q *EffectsQ) Page(page db2.PageQuery) *EffectsQ {
 	if q.Err != nil {
 		return q
@@ -199,6 +354,9 @@ func (q *EffectsQ) Page(page db2.PageQuery) *EffectsQ {
 		q.Err = err
 		return q
 	}
+	if q.Err = q.checkRetention(op); q.Err != nil {
+		return q
+	}
 
 	if idx > math.MaxInt32 {
 		idx = math.MaxInt32
@@ -208,28 +366,222 @@ func (q *EffectsQ) Page(page db2.PageQuery) *EffectsQ {
 	// before changing them.
 	// This condition is using multicolumn index and it's easy to write it in a way that
 	// DB will perform a full table scan.
-	switch page.Order {
+	sql, err := effectsKeysetPredicate(q.sql, op, int32(idx), page.Order)
+	if err != nil {
+		q.Err = err
+		return q
+	}
+	q.sql = sql.Limit(page.Limit)
+	return q
+}
+
+// effectsKeysetPredicate returns the keyset predicate and ORDER BY clause
+// used to resume a heff scan after (opID, order) in the given direction
+// ("asc" or "desc"). Both Page's plain "<op>-<idx>" cursor and the
+// self-describing EffectsCursor build on this helper so the two pagination
+// schemes share one definition of the scan boundary instead of drifting
+// apart.
+func effectsKeysetPredicate(sql sq.SelectBuilder, opID int64, order int32, direction string) (sq.SelectBuilder, error) {
+	switch direction {
 	case "asc":
-		q.sql = q.sql.
+		return sql.
 			Where(`(
 					 heff.history_operation_id >= ?
 				AND (
 					 heff.history_operation_id > ? OR
 					(heff.history_operation_id = ? AND heff.order > ?)
-				))`, op, op, op, idx).
-			OrderBy("heff.history_operation_id asc, heff.order asc")
+				))`, opID, opID, opID, order).
+			OrderBy("heff.history_operation_id asc, heff.order asc"), nil
 	case "desc":
-		q.sql = q.sql.
+		return sql.
 			Where(`(
 					 heff.history_operation_id <= ?
 				AND (
 					 heff.history_operation_id < ? OR
 					(heff.history_operation_id = ? AND heff.order < ?)
-				))`, op, op, op, idx).
-			OrderBy("heff.history_operation_id desc, heff.order desc")
+				))`, opID, opID, opID, order).
+			OrderBy("heff.history_operation_id desc, heff.order desc"), nil
+	default:
+		return sql, errors.Errorf("invalid paging order: %s", direction)
+	}
+}
+
+const effectsCursorVersion = 1
+
+// EffectsCursor is a self-describing, opaque keyset pagination token for
+// EffectsQ. Unlike the plain "<op>-<idx>" cursor used by Page, it carries a
+// fingerprint of the filters it was minted under, so a token handed back to
+// a query with a different filter set is rejected instead of silently
+// returning a mismatched page. The Direction it carries is not checked:
+// Cursor scans in whichever direction its caller passes.
+type EffectsCursor struct {
+	OpID      int64
+	Order     int32
+	Direction string
+	filterKey string
+}
+
+// Encode renders the cursor as the opaque token clients should pass back.
+func (c EffectsCursor) Encode() string {
+	raw := fmt.Sprintf("%d|%d|%d|%s|%s", effectsCursorVersion, c.OpID, c.Order, c.Direction, c.filterKey)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeEffectsCursor parses a token produced by EffectsCursor.Encode.
+func decodeEffectsCursor(token string) (EffectsCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return EffectsCursor{}, errors.Wrap(err, "invalid cursor encoding")
+	}
+
+	parts := strings.SplitN(string(raw), "|", 5)
+	if len(parts) != 5 {
+		return EffectsCursor{}, errors.New("invalid cursor: malformed token")
+	}
+
+	if parts[0] != strconv.Itoa(effectsCursorVersion) {
+		return EffectsCursor{}, errors.Errorf("invalid cursor: unsupported version %q", parts[0])
+	}
+
+	opID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return EffectsCursor{}, errors.Wrap(err, "invalid cursor: bad operation id")
+	}
+
+	order, err := strconv.ParseInt(parts[2], 10, 32)
+	if err != nil {
+		return EffectsCursor{}, errors.Wrap(err, "invalid cursor: bad order")
+	}
+
+	return EffectsCursor{
+		OpID:      opID,
+		Order:     int32(order),
+		Direction: parts[3],
+		filterKey: parts[4],
+	}, nil
+}
+
+// FilterKey fingerprints the filters applied to q so far (everything other
+// than paging), so a cursor minted under a different filter set can be
+// rejected rather than quietly returning the wrong rows. Callers must
+// compute it once, right after applying their filters (ForAccount,
+// ForLedger, ...) and before calling Cursor or SelectCursorPage, and pass
+// that same value to both: Cursor itself appends a paging predicate to
+// q.sql, so a key computed afterwards would fingerprint that predicate
+// instead of the caller's actual filters and would never match again on
+// the next page.
+func (q *EffectsQ) FilterKey() (string, error) {
+	if q.Err != nil {
+		return "", q.Err
+	}
+
+	sql, args, err := q.sql.ToSql()
+	if err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%v", sql, args)
+	return strconv.FormatUint(h.Sum64(), 16), nil
+}
+
+// Cursor applies a keyset pagination token previously returned as the
+// NextCursor or PrevCursor of an EffectsPage, continuing the scan in
+// `direction` ("asc" or "desc") from that point. `filterKey` must be the
+// value FilterKey returned for q's filters before this call; it is
+// compared against the key the token was minted with, so a token minted
+// against a different set of filters is rejected instead of returning a
+// mismatched page.
+func (q *EffectsQ) Cursor(filterKey, token string, limit uint64, direction string) *EffectsQ {
+	if q.Err != nil {
+		return q
 	}
 
-	q.sql = q.sql.Limit(page.Limit)
+	cursor, err := decodeEffectsCursor(token)
+	if err != nil {
+		q.Err = err
+		return q
+	}
+	if cursor.filterKey != filterKey {
+		q.Err = errors.New("cursor was minted for a different set of filters")
+		return q
+	}
+
+	sql, err := effectsKeysetPredicate(q.sql, cursor.OpID, cursor.Order, direction)
+	if err != nil {
+		q.Err = err
+		return q
+	}
+	q.sql = sql.Limit(limit)
+	return q
+}
+
+// EffectsPage bundles a cursor-paginated result set with the tokens needed
+// to continue traversal in either direction from its edges.
+type EffectsPage struct {
+	Records    []Effect
+	NextCursor string
+	PrevCursor string
+}
+
+// SelectCursorPage executes the query built by q (typically via First or
+// Cursor) and returns the matching rows together with the
+// NextCursor/PrevCursor tokens for continuing the scan forward or backward
+// from this page. `filterKey` must be the same value passed to Cursor (or
+// obtained from FilterKey for a first page), so the minted tokens
+// fingerprint the caller's filters rather than the paging predicate this
+// query already carries.
+func (q *EffectsQ) SelectCursorPage(ctx context.Context, filterKey, direction string) (EffectsPage, error) {
+	if q.Err != nil {
+		return EffectsPage{}, q.Err
+	}
+
+	if direction != "asc" && direction != "desc" {
+		return EffectsPage{}, errors.Errorf("invalid cursor direction: %s", direction)
+	}
+
+	var records []Effect
+	if err := q.parent.Select(ctx, &records, q.sql); err != nil {
+		return EffectsPage{}, err
+	}
+
+	page := EffectsPage{Records: records}
+	if len(records) == 0 {
+		return page, nil
+	}
+
+	first, last := records[0], records[len(records)-1]
+	reverse := "desc"
+	if direction == "desc" {
+		reverse = "asc"
+	}
+	page.NextCursor = EffectsCursor{OpID: last.HistoryOperationID, Order: last.Order, Direction: direction, filterKey: filterKey}.Encode()
+	page.PrevCursor = EffectsCursor{OpID: first.HistoryOperationID, Order: first.Order, Direction: reverse, filterKey: filterKey}.Encode()
+
+	return page, nil
+}
+
+// First specifies the paging constraints for the first page of a
+// cursor-based scan, i.e. one with no prior token to resume from. Combined
+// with FilterKey and SelectCursorPage, this is how callers outside package
+// history start keyset pagination without reaching into EffectsCursor
+// directly.
+func (q *EffectsQ) First(direction string, limit uint64) *EffectsQ {
+	if q.Err != nil {
+		return q
+	}
+
+	switch direction {
+	case "asc":
+		q.sql = q.sql.OrderBy("heff.history_operation_id asc, heff.order asc")
+	case "desc":
+		q.sql = q.sql.OrderBy("heff.history_operation_id desc, heff.order desc")
+	default:
+		q.Err = errors.Errorf("invalid cursor direction: %s", direction)
+		return q
+	}
+
+	q.sql = q.sql.Limit(limit)
 	return q
 }
 
@@ -243,6 +595,131 @@ func (q *EffectsQ) Select(ctx context.Context, dest interface{}) error {
 	return q.Err
 }
 
+// EffectsWithLedgersQ wraps an EffectsQ so that Select also hydrates the
+// ledgers referenced by the returned rows.
+type EffectsWithLedgersQ struct {
+	*EffectsQ
+}
+
+// EffectsWithLedgers bundles effect rows with the ledgers they reference,
+// keyed by ledger sequence.
+type EffectsWithLedgers struct {
+	Records       []Effect
+	LedgerRecords map[int32]Ledger
+}
+
+// WithLedgers switches the query into a mode where Select also returns the
+// distinct ledgers referenced by the matched effects, hydrated with a
+// single LedgersBySequence lookup rather than a per-row lookup. This mirrors
+// the pattern used for trades and lets resources populate `created_at`
+// without reingesting history.
+func (q *EffectsQ) WithLedgers() *EffectsWithLedgersQ {
+	return &EffectsWithLedgersQ{q}
+}
+
+// Select loads the rows matched by the underlying query along with the
+// distinct ledgers they reference.
+func (q *EffectsWithLedgersQ) Select(ctx context.Context) (EffectsWithLedgers, error) {
+	if q.Err != nil {
+		return EffectsWithLedgers{}, q.Err
+	}
+
+	var records []Effect
+	if err := q.parent.Select(ctx, &records, q.sql); err != nil {
+		return EffectsWithLedgers{}, err
+	}
+
+	seqSet := make(map[int32]struct{}, len(records))
+	for _, r := range records {
+		seqSet[r.LedgerSequence()] = struct{}{}
+	}
+
+	seqs := make([]int32, 0, len(seqSet))
+	for seq := range seqSet {
+		seqs = append(seqs, seq)
+	}
+
+	ledgers := make(map[int32]Ledger, len(seqs))
+	if len(seqs) > 0 {
+		var ledgerRecords []Ledger
+		if err := q.parent.LedgersBySequence(ctx, &ledgerRecords, seqs...); err != nil {
+			return EffectsWithLedgers{}, err
+		}
+		for _, l := range ledgerRecords {
+			ledgers[l.Sequence] = l
+		}
+	}
+
+	return EffectsWithLedgers{Records: records, LedgerRecords: ledgers}, nil
+}
+
+// EffectsIterationProgress tracks how far a call to EffectsQ.Iterate has
+// scanned the result set, keyed by the history_operation_id of the last row
+// observed, so a long-running job can checkpoint and resume.
+type EffectsIterationProgress struct {
+	lastOperationID int64
+}
+
+// HistoryOperationID returns the history_operation_id of the last row
+// Iterate has observed, or zero before the first row is scanned. Safe to
+// call concurrently with the Iterate call it reports on.
+func (p *EffectsIterationProgress) HistoryOperationID() int64 {
+	return atomic.LoadInt64(&p.lastOperationID)
+}
+
+// EffectsIterationOptions configures EffectsQ.Iterate.
+type EffectsIterationOptions struct {
+	// Progress, if set, is updated with the history_operation_id of every
+	// row Iterate scans, for resumable jobs to checkpoint against.
+	Progress *EffectsIterationProgress
+	// ContinueOnRowError, when true, keeps scanning after onRow returns an
+	// error instead of stopping Iterate. Useful for reingestion tools and
+	// exporters that would rather skip a row that fails to
+	// UnmarshalDetails than abandon the rest of the scan.
+	ContinueOnRowError bool
+}
+
+// Iterate executes the query built by q with a server-side cursor and
+// invokes onRow once per matching effect, instead of materializing the
+// full result set into a slice the way Select does. This is needed by
+// reingestion tools, exporters, and the SSE /effects stream, which need to
+// walk the entire history_effects table rather than a single page.
+//
+// Iterate stops and returns as soon as ctx is cancelled, or onRow returns
+// an error and opts.ContinueOnRowError is false.
+func (q *EffectsQ) Iterate(ctx context.Context, onRow func(*Effect) error, opts EffectsIterationOptions) error {
+	if q.Err != nil {
+		return q.Err
+	}
+
+	rows, err := q.parent.Query(ctx, q.sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var effect Effect
+		if err := rows.StructScan(&effect); err != nil {
+			return errors.Wrap(err, "scanning history_effects row")
+		}
+
+		if opts.Progress != nil {
+			atomic.StoreInt64(&opts.Progress.lastOperationID, effect.HistoryOperationID)
+		}
+
+		if err := onRow(&effect); err != nil && !opts.ContinueOnRowError {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
 // QEffects defines history_effects related queries.
 type QEffects interface {
 	QCreateAccountsHistory
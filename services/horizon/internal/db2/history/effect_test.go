@@ -0,0 +1,71 @@
+package history
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/stellar/go/protocols/horizon/effects"
+)
+
+func TestEffect_UnmarshalDetails_Trade_RealOfferID(t *testing.T) {
+	effect := Effect{
+		HistoryOperationID: 12884905984,
+		DetailsString:      sql.NullString{String: `{"offer_id": 54321}`, Valid: true},
+	}
+
+	var dest effects.Trade
+	require.NoError(t, effect.UnmarshalDetails(&dest))
+
+	assert.Equal(t, int64(54321), dest.OfferID)
+}
+
+func TestEffect_UnmarshalDetails_Trade_SynthesizesMissingOfferID(t *testing.T) {
+	effect := Effect{
+		HistoryOperationID: 12884905984,
+		DetailsString:      sql.NullString{String: `{"offer_id": 0}`, Valid: true},
+	}
+
+	var dest effects.Trade
+	require.NoError(t, effect.UnmarshalDetails(&dest))
+
+	assert.Equal(t, EncodeOfferId(uint64(effect.HistoryOperationID), OfferIDTypeTOID), dest.OfferID)
+	assert.NotEqual(t, int64(0), dest.OfferID)
+}
+
+// withSyntheticOfferID is tested directly against its raw JSON output
+// rather than through a destination struct, since the "raw_offer_id" field
+// it writes isn't guaranteed to exist on effects.Trade yet.
+func TestEffect_withSyntheticOfferID(t *testing.T) {
+	effect := Effect{HistoryOperationID: 12884905984}
+
+	t.Run("real core offer id is left untouched", func(t *testing.T) {
+		out, err := effect.withSyntheticOfferID([]byte(`{"offer_id": 54321}`))
+		require.NoError(t, err)
+
+		var fields map[string]interface{}
+		require.NoError(t, json.Unmarshal(out, &fields))
+		assert.EqualValues(t, 54321, fields["offer_id"])
+		assert.NotContains(t, fields, "raw_offer_id")
+	})
+
+	t.Run("missing offer id is synthesized and preserved", func(t *testing.T) {
+		out, err := effect.withSyntheticOfferID([]byte(`{"offer_id": 0}`))
+		require.NoError(t, err)
+
+		var fields map[string]interface{}
+		require.NoError(t, json.Unmarshal(out, &fields))
+		assert.EqualValues(t, 0, fields["raw_offer_id"])
+		assert.EqualValues(t, EncodeOfferId(uint64(effect.HistoryOperationID), OfferIDTypeTOID), fields["offer_id"])
+		assert.NotZero(t, fields["offer_id"])
+	})
+}
+
+func TestEncodeOfferId(t *testing.T) {
+	coreID := EncodeOfferId(54321, OfferIDTypeCore)
+	toidID := EncodeOfferId(54321, OfferIDTypeTOID)
+	assert.NotEqual(t, coreID, toidID)
+}
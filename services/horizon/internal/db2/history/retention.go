@@ -0,0 +1,16 @@
+package history
+
+// RetentionMinLedger returns the oldest ledger sequence this Q's configured
+// HistoryRetentionCount still guarantees is present. It returns 0 when no
+// retention window is configured, meaning full history is retained and
+// callers should not enforce a bound.
+//
+// q.retentionMinLedger is a field on this *Q instance, not process-global
+// state: it is populated once when the session/config that constructs Q is
+// set up (from horizon's HistoryRetentionCount and the ledger range the
+// reaper has already cleared), so two Q instances in the same process --
+// e.g. ones under test, or ones for two differently-configured horizon
+// deployments -- never see each other's retention boundary.
+func (q *Q) RetentionMinLedger() int32 {
+	return q.retentionMinLedger
+}